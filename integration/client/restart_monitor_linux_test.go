@@ -18,7 +18,9 @@ package client
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"syscall"
 	"testing"
 	"time"
@@ -28,13 +30,16 @@ import (
 	"github.com/containerd/containerd/oci"
 )
 
-// TestRestartMonitor tests restarting containers
-// with the restart monitor service plugin
+// TestRestartMonitor tests restarting containers with the restart
+// monitor service plugin. Restarts are dispatched off the task exit
+// event stream, so the monitor recovers well within `interval`; a
+// large `interval` is configured here specifically to prove that the
+// reconciliation sweep isn't what's restarting the task.
 func TestRestartMonitor(t *testing.T) {
 	const (
 		interval = 10 * time.Second
-		epsilon  = 1 * time.Second
-		count    = 20
+		epsilon  = 100 * time.Millisecond
+		count    = 10
 	)
 	configTOML := fmt.Sprintf(`
 version = 2
@@ -85,8 +90,14 @@ version = 2
 
 	begin := time.Now()
 
-	expected := begin.Add(interval).Add(epsilon)
-	deadline := begin.Add(interval).Add(epsilon * count)
+	// With events flowing, the restart must land well below interval.
+	// The monitor first waits out the first backoff step: this container
+	// sets no backoff label, so that is restart.DefaultBackoff's 1s
+	// initial delay with up to 20% jitter, i.e. at most 1.2s. A further
+	// 1s comfortably covers scheduling and the daemon's own overhead
+	// without masking a regression back to interval-bound polling.
+	expected := begin.Add(1200 * time.Millisecond).Add(1 * time.Second)
+	deadline := expected.Add(epsilon * count)
 	for {
 		status, err := task.Status(ctx)
 		now := time.Now()
@@ -115,6 +126,353 @@ version = 2
 	t.Logf("%v: the task was restarted before %v", now, expected)
 }
 
+// TestRestartMonitorPolicy tests that the restart monitor honors the
+// `containerd.io/restart.policy` label for each of the well-known
+// policies, and that `on-failure` stops retrying once max-retries is
+// exhausted.
+func TestRestartMonitorPolicy(t *testing.T) {
+	const interval = 2 * time.Second
+	configTOML := fmt.Sprintf(`
+version = 2
+[plugins]
+  [plugins."io.containerd.internal.v1.restart"]
+	  interval = "%s"
+`, interval.String())
+	client, _, cleanup := newDaemonWithConfig(t, configTOML)
+	defer cleanup()
+
+	for _, test := range []struct {
+		name        string
+		policy      string
+		exitCode    int
+		wantRestart bool
+	}{
+		{name: "always restarts a cleanly exited container", policy: "always", exitCode: 0, wantRestart: true},
+		{name: "unless-stopped restarts a crashed container", policy: "unless-stopped", exitCode: 1, wantRestart: true},
+		{name: "on-failure restarts a crashed container", policy: "on-failure", exitCode: 1, wantRestart: true},
+		{name: "on-failure does not restart a clean exit", policy: "on-failure", exitCode: 0, wantRestart: false},
+		{name: "no never restarts", policy: "no", exitCode: 1, wantRestart: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := testContext(t)
+			defer cancel()
+			id := t.Name()
+
+			image, err := client.Pull(ctx, testImage, WithPullUnpack)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			container, err := client.NewContainer(ctx, id,
+				WithNewSnapshot(id, image),
+				WithNewSpec(
+					oci.WithImageConfig(image),
+					withProcessArgs("sh", "-c", fmt.Sprintf("exit %d", test.exitCode)),
+				),
+				withRestartStatus(Running),
+				withRestartPolicy(test.policy),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer container.Delete(ctx, WithSnapshotCleanup)
+
+			task, err := container.NewTask(ctx, empty())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer task.Delete(ctx, WithProcessKill)
+
+			if err := task.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			deadline := time.Now().Add(interval * 3)
+			restarted := false
+			for time.Now().Before(deadline) {
+				if status, err := task.Status(ctx); err == nil && status.Status == Running {
+					restarted = true
+					break
+				}
+				time.Sleep(200 * time.Millisecond)
+			}
+			if restarted != test.wantRestart {
+				t.Fatalf("policy %q: restarted=%v, want %v", test.policy, restarted, test.wantRestart)
+			}
+		})
+	}
+}
+
+// TestRestartMonitorHealthCheck tests that a container with an
+// always-failing health check is killed, and then restarted by the
+// monitor's normal restart path, once startPeriod and retries have
+// elapsed.
+func TestRestartMonitorHealthCheck(t *testing.T) {
+	const (
+		startPeriod    = 2 * time.Second
+		healthInterval = 1 * time.Second
+		healthTimeout  = 1 * time.Second
+		retries        = 3
+	)
+	configTOML := `
+version = 2
+[plugins]
+  [plugins."io.containerd.internal.v1.restart"]
+	  interval = "10s"
+`
+	client, _, cleanup := newDaemonWithConfig(t, configTOML)
+	defer cleanup()
+
+	ctx, cancel := testContext(t)
+	defer cancel()
+	id := t.Name()
+
+	image, err := client.Pull(ctx, testImage, WithPullUnpack)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container, err := client.NewContainer(ctx, id,
+		WithNewSnapshot(id, image),
+		WithNewSpec(
+			oci.WithImageConfig(image),
+			withProcessArgs("sleep", "infinity"),
+		),
+		withRestartStatus(Running),
+		withRestartPolicy("always"),
+		withRestartHealthCheck([]string{"false"}, healthInterval, healthTimeout, retries, startPeriod),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer container.Delete(ctx, WithSnapshotCleanup)
+
+	task, err := container.NewTask(ctx, empty())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer task.Delete(ctx, WithProcessKill)
+
+	if err := task.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	firstPid := task.Pid()
+
+	// The health runner starts as soon as the task-start event for this
+	// container is observed, so the request's own bound applies directly;
+	// only a couple of seconds of scheduling/daemon overhead are added.
+	deadline := time.Now().Add(startPeriod + retries*healthInterval + 2*time.Second)
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("container was not killed and restarted by the unhealthy health check")
+		}
+		status, err := task.Status(ctx)
+		if err == nil && status.Status == Running && task.Pid() != firstPid {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// withRestartHealthCheck is a copy of
+// "github.com/containerd/containerd/runtime/restart".WithHealthCheck.
+// This copy is needed because `go test` refuses circular imports.
+func withRestartHealthCheck(cmd []string, interval, timeout time.Duration, retries int, startPeriod time.Duration) func(context.Context, *Client, *containers.Container) error {
+	return func(_ context.Context, _ *Client, c *containers.Container) error {
+		hc := struct {
+			Cmd         []string
+			Interval    time.Duration
+			Timeout     time.Duration
+			Retries     int
+			StartPeriod time.Duration
+		}{cmd, interval, timeout, retries, startPeriod}
+		b, err := json.Marshal(hc)
+		if err != nil {
+			return err
+		}
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		c.Labels["containerd.io/restart.healthcheck"] = string(b)
+		return nil
+	}
+}
+
+// TestRestartMonitorExitOnNext tests that a task killed after
+// restart.ExitOnNext was called for it stays exited: the monitor must
+// skip exactly the one restart it would otherwise have performed.
+func TestRestartMonitorExitOnNext(t *testing.T) {
+	const (
+		interval = 10 * time.Second
+		epsilon  = 1 * time.Second
+		count    = 20
+	)
+	configTOML := fmt.Sprintf(`
+version = 2
+[plugins]
+  [plugins."io.containerd.internal.v1.restart"]
+	  interval = "%s"
+`, interval.String())
+	client, _, cleanup := newDaemonWithConfig(t, configTOML)
+	defer cleanup()
+
+	ctx, cancel := testContext(t)
+	defer cancel()
+	id := t.Name()
+
+	image, err := client.Pull(ctx, testImage, WithPullUnpack)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container, err := client.NewContainer(ctx, id,
+		WithNewSnapshot(id, image),
+		WithNewSpec(
+			oci.WithImageConfig(image),
+			withProcessArgs("sleep", "infinity"),
+		),
+		withRestartStatus(Running),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer container.Delete(ctx, WithSnapshotCleanup)
+
+	task, err := container.NewTask(ctx, empty())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer task.Delete(ctx, WithProcessKill)
+
+	if err := task.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setCancelNext(ctx, container, task.Pid()); err != nil {
+		t.Fatal(err)
+	}
+	if err := task.Kill(ctx, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(interval).Add(epsilon * count)
+	for time.Now().Before(deadline) {
+		if status, err := task.Status(ctx); err == nil && status.Status == Running {
+			t.Fatalf("%v: task with ExitOnNext set must not be restarted", time.Now())
+		}
+		time.Sleep(epsilon)
+	}
+}
+
+// setCancelNext is a copy of "github.com/containerd/containerd/runtime/restart".ExitOnNext.
+// This copy is needed because `go test` refuses circular imports.
+func setCancelNext(ctx context.Context, container Container, pid uint32) error {
+	_, err := container.Update(ctx, func(_ context.Context, _ *Client, c *containers.Container) error {
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		c.Labels["containerd.io/restart.cancel-next"] = strconv.FormatUint(uint64(pid), 10)
+		return nil
+	})
+	return err
+}
+
+// TestRestartMonitorUnlessStoppedHonorsManualStop tests that a
+// `unless-stopped` container whose task was killed after the client set
+// the manual-stop marker label stays exited, while one crashed without
+// the marker is restarted as usual.
+func TestRestartMonitorUnlessStoppedHonorsManualStop(t *testing.T) {
+	const interval = 2 * time.Second
+	configTOML := fmt.Sprintf(`
+version = 2
+[plugins]
+  [plugins."io.containerd.internal.v1.restart"]
+	  interval = "%s"
+`, interval.String())
+	client, _, cleanup := newDaemonWithConfig(t, configTOML)
+	defer cleanup()
+
+	for _, test := range []struct {
+		name        string
+		manualStop  bool
+		wantRestart bool
+	}{
+		{name: "crash without manual-stop marker is restarted", manualStop: false, wantRestart: true},
+		{name: "kill after manual-stop marker stays exited", manualStop: true, wantRestart: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := testContext(t)
+			defer cancel()
+			id := t.Name()
+
+			image, err := client.Pull(ctx, testImage, WithPullUnpack)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			container, err := client.NewContainer(ctx, id,
+				WithNewSnapshot(id, image),
+				WithNewSpec(
+					oci.WithImageConfig(image),
+					withProcessArgs("sleep", "infinity"),
+				),
+				withRestartStatus(Running),
+				withRestartPolicy("unless-stopped"),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer container.Delete(ctx, WithSnapshotCleanup)
+
+			task, err := container.NewTask(ctx, empty())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer task.Delete(ctx, WithProcessKill)
+
+			if err := task.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.manualStop {
+				if err := setManuallyStopped(ctx, container, task.Pid()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := task.Kill(ctx, syscall.SIGKILL); err != nil {
+				t.Fatal(err)
+			}
+
+			deadline := time.Now().Add(interval * 3)
+			restarted := false
+			for time.Now().Before(deadline) {
+				if status, err := task.Status(ctx); err == nil && status.Status == Running {
+					restarted = true
+					break
+				}
+				time.Sleep(200 * time.Millisecond)
+			}
+			if restarted != test.wantRestart {
+				t.Fatalf("manualStop=%v: restarted=%v, want %v", test.manualStop, restarted, test.wantRestart)
+			}
+		})
+	}
+}
+
+// setManuallyStopped is a copy of
+// "github.com/containerd/containerd/runtime/restart".SetManuallyStopped.
+// This copy is needed because `go test` refuses circular imports.
+func setManuallyStopped(ctx context.Context, container Container, pid uint32) error {
+	_, err := container.Update(ctx, func(_ context.Context, _ *Client, c *containers.Container) error {
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		c.Labels["containerd.io/restart.manually-stopped"] = strconv.FormatUint(uint64(pid), 10)
+		return nil
+	})
+	return err
+}
+
 // withRestartStatus is a copy of "github.com/containerd/containerd/runtime/restart".WithStatus.
 // This copy is needed because `go test` refuses circular imports.
 func withRestartStatus(status ProcessStatus) func(context.Context, *Client, *containers.Container) error {
@@ -126,3 +484,19 @@ func withRestartStatus(status ProcessStatus) func(context.Context, *Client, *con
 		return nil
 	}
 }
+
+// withRestartPolicy is a simplified copy of
+// "github.com/containerd/containerd/runtime/restart".WithPolicy: it always
+// sets max-retries to 1 and writes no backoff label, so the monitor uses
+// restart.DefaultBackoff. This copy is needed because `go test` refuses
+// circular imports.
+func withRestartPolicy(policy string) func(context.Context, *Client, *containers.Container) error {
+	return func(_ context.Context, _ *Client, c *containers.Container) error {
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		c.Labels["containerd.io/restart.policy"] = policy
+		c.Labels["containerd.io/restart.max-retries"] = "1"
+		return nil
+	}
+}
@@ -0,0 +1,213 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/runtime/restart"
+)
+
+// healthMonitors tracks the single health-runner goroutine started per
+// container that carries a restart.HealthCheckLabel, keyed by container
+// ID, so reconciliation sweeps don't spawn duplicate runners for a
+// container that's already being probed.
+type healthMonitors struct {
+	mu   sync.Mutex
+	done map[string]chan struct{}
+}
+
+func newHealthMonitors() *healthMonitors {
+	return &healthMonitors{done: make(map[string]chan struct{})}
+}
+
+// ensure starts a health-runner for id if the container has a health
+// check configured and one isn't already running for it. It takes just
+// the container ID rather than a container reference, so callers on the
+// reconciliation-sweep path can drive it without depending on the
+// concrete containerd.Container type (see restartContainer in store.go).
+func (h *healthMonitors) ensure(m *monitor, ctx context.Context, id string, labels map[string]string) {
+	hc, ok, err := restart.GetHealthCheck(labels)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("id", id).Warn("restart monitor: invalid healthcheck label")
+		return
+	}
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, running := h.done[id]; running {
+		return
+	}
+	done := make(chan struct{})
+	h.done[id] = done
+	runCtx := context.Background()
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		runCtx = namespaces.WithNamespace(runCtx, ns)
+	}
+	go func() {
+		runHealthCheck(runCtx, m.client, id, hc, done)
+		h.mu.Lock()
+		delete(h.done, id)
+		h.mu.Unlock()
+	}()
+}
+
+// stop tears down the health-runner for a container, if any, so a
+// restarted task gets a fresh runner instead of racing the old one.
+func (h *healthMonitors) stop(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if done, ok := h.done[id]; ok {
+		close(done)
+		delete(h.done, id)
+	}
+}
+
+// runHealthCheck probes the container identified by id on hc.Interval,
+// starting after hc.StartPeriod has elapsed, and kills the task once
+// hc.Retries consecutive probes have failed. The resulting exit then
+// flows through the normal restart path, so no restart logic lives
+// here. The container is loaded (rather than passed in) so this can be
+// driven off just an ID, matching ensure's signature.
+func runHealthCheck(ctx context.Context, client *containerd.Client, id string, hc restart.HealthCheck, done chan struct{}) {
+	c, err := client.LoadContainer(ctx, id)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("id", id).Warn("restart monitor: load container for healthcheck")
+		return
+	}
+
+	setHealth(ctx, c, restart.HealthStarting, 0, "")
+
+	select {
+	case <-time.After(hc.StartPeriod):
+	case <-done:
+		return
+	}
+
+	var failures int
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		output, healthy := probe(ctx, c, hc)
+		if healthy {
+			failures = 0
+			setHealth(ctx, c, restart.HealthHealthy, failures, output)
+		} else {
+			failures++
+			setHealth(ctx, c, restart.HealthUnhealthy, failures, output)
+			if failures >= hc.Retries {
+				killUnhealthy(ctx, c, hc.Timeout)
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// probe runs hc.Cmd once inside the container's task and reports its
+// combined stdout/stderr and whether it exited zero.
+func probe(ctx context.Context, c containerd.Container, hc restart.HealthCheck) (string, bool) {
+	task, err := c.Task(ctx, nil)
+	if err != nil {
+		return err.Error(), false
+	}
+
+	spec, err := c.Spec(ctx)
+	if err != nil {
+		return err.Error(), false
+	}
+	process := *spec.Process
+	process.Args = hc.Cmd
+
+	var output bytes.Buffer
+	execID := "health-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	exec, err := task.Exec(ctx, execID, &process, cio.NewCreator(cio.WithStreams(nil, &output, &output)))
+	if err != nil {
+		return err.Error(), false
+	}
+	defer exec.Delete(ctx)
+
+	statusC, err := exec.Wait(ctx)
+	if err != nil {
+		return err.Error(), false
+	}
+	if err := exec.Start(ctx); err != nil {
+		return err.Error(), false
+	}
+
+	select {
+	case status := <-statusC:
+		return output.String(), status.ExitCode() == 0
+	case <-time.After(hc.Timeout):
+		exec.Kill(ctx, syscall.SIGKILL)
+		return "health probe timed out after " + hc.Timeout.String(), false
+	}
+}
+
+// killUnhealthy asks the task to exit gracefully, escalating to SIGKILL
+// if it hasn't stopped within timeout.
+func killUnhealthy(ctx context.Context, c containerd.Container, timeout time.Duration) {
+	task, err := c.Task(ctx, nil)
+	if err != nil {
+		return
+	}
+	statusC, err := task.Wait(ctx)
+	if err != nil {
+		return
+	}
+	if err := task.Kill(ctx, syscall.SIGTERM); err != nil {
+		log.G(ctx).WithError(err).WithField("id", c.ID()).Warn("restart monitor: SIGTERM unhealthy task")
+	}
+	select {
+	case <-statusC:
+	case <-time.After(timeout):
+		task.Kill(ctx, syscall.SIGKILL)
+	}
+}
+
+func setHealth(ctx context.Context, c containerd.Container, status string, failures int, output string) {
+	_, err := c.Update(ctx, func(_ context.Context, _ *containerd.Client, cc *containers.Container) error {
+		if cc.Labels == nil {
+			cc.Labels = make(map[string]string)
+		}
+		cc.Labels[restart.HealthStatusLabel] = status
+		cc.Labels[restart.HealthFailuresLabel] = strconv.Itoa(failures)
+		cc.Labels[restart.HealthLastOutputLabel] = output
+		return nil
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("id", c.ID()).Warn("restart monitor: update health labels")
+	}
+}
@@ -0,0 +1,459 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package monitor implements the "io.containerd.internal.v1.restart"
+// plugin: it keeps running containers whose StatusLabel is Running
+// reconciled with that desired state, restarting them according to
+// their restart policy.
+//
+// Restarts are primarily driven by the task exit event stream, so
+// recovery latency does not depend on Config.Interval; Interval only
+// governs a reconciliation sweep that catches containers whose exit
+// event was missed, e.g. because the monitor itself crashed or
+// containerd was restarted.
+package monitor
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd"
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/plugin"
+	"github.com/containerd/containerd/runtime/restart"
+	"github.com/containerd/typeurl"
+)
+
+func init() {
+	plugin.Register(&plugin.Registration{
+		Type: plugin.InternalPlugin,
+		ID:   "restart",
+		Requires: []plugin.Type{
+			plugin.ServicePlugin,
+		},
+		Config: &Config{
+			Interval: "10s",
+		},
+		InitFn: New,
+	})
+}
+
+// Config configures the restart monitor plugin.
+type Config struct {
+	// Interval is how often the monitor falls back to walking the
+	// container store, in case a task exit event was missed. It does
+	// not bound restart latency while events are flowing.
+	Interval string `toml:"interval"`
+}
+
+// New creates the restart monitor from its plugin configuration.
+func New(ic *plugin.InitContext) (interface{}, error) {
+	interval, err := time.ParseDuration(ic.Config.(*Config).Interval)
+	if err != nil {
+		return nil, err
+	}
+	client, err := containerd.New("", containerd.WithDefaultNamespace(namespaces.Default))
+	if err != nil {
+		return nil, err
+	}
+	m := &monitor{
+		interval: interval,
+		client:   client,
+		done:     make(chan struct{}),
+		health:   newHealthMonitors(),
+		restarts: newRestartWorkers(),
+	}
+	go m.run()
+	return m, nil
+}
+
+// monitor restarts containers whose task has stopped but whose restart
+// policy says it should still be running. Restarts are dispatched as
+// soon as the task's exit event is observed; the interval-based
+// reconciliation sweep only exists to catch events that were missed.
+type monitor struct {
+	interval time.Duration
+	client   *containerd.Client
+	done     chan struct{}
+	// health tracks the per-container health-check runner goroutines
+	// started for containers carrying restart.HealthCheckLabel.
+	health *healthMonitors
+	// restarts dispatches each container's restart (and its backoff
+	// wait) onto its own goroutine, so run()'s select loop never blocks
+	// on one.
+	restarts *restartWorkers
+}
+
+// subscribe opens the task-exit/task-start event subscription. Exit
+// drives restarts without waiting on the reconciliation sweep; start,
+// in addition to exit, lets a health-check runner begin the moment a
+// container's task is actually running, rather than waiting on that
+// same sweep or on the monitor having performed the start itself.
+func (m *monitor) subscribe(ctx context.Context) (<-chan *events.Envelope, <-chan error) {
+	return m.client.EventService().Subscribe(ctx, `topic=="/tasks/exit"`, `topic=="/tasks/start"`)
+}
+
+func (m *monitor) run() {
+	ctx := context.Background()
+
+	ch, errCh := m.subscribe(ctx)
+
+	// The monitor may have missed exits that happened while it was not
+	// yet subscribed (e.g. right after containerd restarted), so sweep
+	// once on startup before settling into the event loop.
+	m.reconcile(ctx)
+
+	for {
+		select {
+		case e := <-ch:
+			m.handleEvent(ctx, e)
+		case err := <-errCh:
+			// A subscription error ends that subscription for good, so
+			// this must resubscribe -- otherwise the monitor is
+			// permanently downgraded to interval-only polling for the
+			// rest of the process's life.
+			log.G(ctx).WithError(err).Error("restart monitor: event subscription error, resubscribing")
+			m.reconcile(ctx)
+			ch, errCh = m.subscribe(ctx)
+		case <-time.After(m.interval):
+			m.reconcile(ctx)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// handleEvent dispatches off the task exit and task start events: an
+// exit drives a restart without waiting for the next reconciliation
+// sweep, and a start kicks off health-check probing (if configured)
+// without waiting on that same sweep or on the monitor having been the
+// one to perform the start.
+func (m *monitor) handleEvent(ctx context.Context, e *events.Envelope) {
+	if e == nil || e.Event == nil {
+		return
+	}
+	v, err := typeurl.UnmarshalAny(e.Event)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("restart monitor: unmarshal event")
+		return
+	}
+
+	ctx = namespaces.WithNamespace(ctx, e.Namespace)
+
+	switch ev := v.(type) {
+	case *eventstypes.TaskExit:
+		// Exec processes (e.g. health probes) publish TaskExit too; only
+		// the init process exiting means the task itself has exited.
+		if ev.ID != ev.ContainerID {
+			return
+		}
+		c, labels, ok := m.loadRunningContainer(ctx, ev.ContainerID)
+		if !ok {
+			return
+		}
+		exitedAt := time.Now()
+		m.restarts.run(ctx, c.ID(), func(ctx context.Context) error {
+			return m.handleExit(ctx, c, labels, ev.Pid, ev.ExitStatus, exitedAt)
+		})
+	case *eventstypes.TaskStart:
+		c, labels, ok := m.loadRunningContainer(ctx, ev.ContainerID)
+		if !ok {
+			return
+		}
+		m.health.ensure(m, ctx, c.ID(), labels)
+	}
+}
+
+// loadRunningContainer loads the container by ID and returns its
+// labels, but only if restart.StatusLabel is still Running — the
+// container may have been deleted or marked stopped between the event
+// firing and this handler running.
+func (m *monitor) loadRunningContainer(ctx context.Context, id string) (restartContainer, map[string]string, bool) {
+	c, err := m.client.LoadContainer(ctx, id)
+	if err != nil {
+		if !errdefs.IsNotFound(err) {
+			log.G(ctx).WithError(err).WithField("id", id).Error("restart monitor: load container")
+		}
+		return nil, nil, false
+	}
+	labels, err := c.Labels(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("id", id).Error("restart monitor: get labels")
+		return nil, nil, false
+	}
+	if restart.Status(labels) != string(containerd.Running) {
+		return nil, nil, false
+	}
+	return liveContainer{c}, labels, true
+}
+
+func (m *monitor) reconcile(ctx context.Context) {
+	nss, err := m.client.NamespaceService().List(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("restart monitor: list namespaces")
+		return
+	}
+	for _, ns := range nss {
+		ctx := namespaces.WithNamespace(ctx, ns)
+		containers, err := listRunning(ctx, m.client, "labels."+strconv.Quote(restart.StatusLabel)+"=="+string(containerd.Running))
+		if err != nil {
+			log.G(ctx).WithError(err).Error("restart monitor: list containers")
+			continue
+		}
+		for _, c := range containers {
+			if err := m.reconcileOne(ctx, c); err != nil {
+				log.G(ctx).WithError(err).WithField("id", c.ID()).Error("restart monitor: reconcile container")
+			}
+		}
+	}
+}
+
+// reconcileOne covers what the event stream cannot: containers that have
+// no task at all (never started, or a previous pass already tore the
+// task down) and containers whose exit event the monitor missed. It is
+// written against restartContainer rather than containerd.Container so
+// it can be exercised against a fake container store at scale; see
+// BenchmarkReconcile.
+func (m *monitor) reconcileOne(ctx context.Context, c restartContainer) error {
+	labels, err := c.Labels(ctx)
+	if err != nil {
+		return err
+	}
+
+	task, err := c.Task(ctx, nil)
+	if err != nil {
+		m.restarts.run(ctx, c.ID(), func(ctx context.Context) error {
+			return m.startMissingTask(ctx, c, labels)
+		})
+		return nil
+	}
+
+	status, err := task.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if status.Status == containerd.Running || status.Status == containerd.Pausing || status.Status == containerd.Paused {
+		m.health.ensure(m, ctx, c.ID(), labels)
+		return nil
+	}
+
+	m.health.stop(c.ID())
+	pid, exitStatus, exitedAt := task.Pid(), status.ExitStatus, status.ExitTime
+	m.restarts.run(ctx, c.ID(), func(ctx context.Context) error {
+		return m.handleExit(ctx, c, labels, pid, exitStatus, exitedAt)
+	})
+	return nil
+}
+
+// handleExit is the common path for a task that is now known to have
+// exited, whether learned from an event or a reconciliation sweep: it
+// tears down the stopped task, honors a pending ExitOnNext, and
+// otherwise applies the container's restart policy.
+func (m *monitor) handleExit(ctx context.Context, c restartContainer, labels map[string]string, pid uint32, exitCode uint32, exitedAt time.Time) error {
+	uptime := taskUptime(labels, exitedAt)
+	restartCount, _ := strconv.Atoi(labels[restart.RestartCountLabel])
+
+	m.health.stop(c.ID())
+
+	if task, err := c.Task(ctx, nil); err == nil {
+		if _, err := task.Delete(ctx); err != nil && !errdefs.IsNotFound(err) {
+			log.G(ctx).WithError(err).WithField("id", c.ID()).Warn("restart monitor: delete stopped task")
+		}
+	}
+
+	if restart.Cancelled(labels, pid) {
+		if _, err := c.Update(ctx, func(_ context.Context, _ *containerd.Client, cc *containers.Container) error {
+			delete(cc.Labels, restart.CancelNextLabel)
+			return nil
+		}); err != nil {
+			log.G(ctx).WithError(err).WithField("id", c.ID()).Warn("restart monitor: clear cancel-next label")
+		}
+		return nil
+	}
+
+	manuallyStopped := restart.ManuallyStopped(labels, pid)
+	return m.start(ctx, c, labels, exitCode, manuallyStopped, restartCount, uptime)
+}
+
+// taskUptime reports how long the task actually ran before exiting at
+// exitedAt, based on restart.LastRestartAtLabel -- the last time the
+// monitor (re)started it. exitedAt alone isn't enough: on the event
+// path it's set to time.Now() when the event is handled (not when the
+// task actually started), and on the sweep path it's the real exit time
+// but says nothing about how long the task ran beforehand. If the label
+// is absent or unparseable (e.g. the container has never been
+// restarted by the monitor), 0 is returned so the uptime-based retry
+// reset conservatively never fires rather than guessing.
+func taskUptime(labels map[string]string, exitedAt time.Time) time.Duration {
+	v, ok := labels[restart.LastRestartAtLabel]
+	if !ok {
+		return 0
+	}
+	startedAt, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0
+	}
+	if uptime := exitedAt.Sub(startedAt); uptime > 0 {
+		return uptime
+	}
+	return 0
+}
+
+// resetRestartCount applies the "a successful uptime greater than
+// initial*10 resets the retry counter" rule. It must run before
+// restartCount is used for anything else — both the max-retries check
+// in decide() and the count start() persists back onto the container
+// need the reset value, not the raw cumulative one.
+func resetRestartCount(restartCount int, uptime time.Duration, backoff restart.Backoff) int {
+	if uptime > backoff.Initial*10 {
+		return 0
+	}
+	return restartCount
+}
+
+// decide implements the restart policy: given why the task exited and
+// how many times (since the last reset) it's already been restarted,
+// should it be restarted again, and after what delay? restartCount must
+// already have resetRestartCount applied.
+func decide(policy string, exitCode uint32, manuallyStopped bool, restartCount int, maxRetries int, backoff restart.Backoff) (bool, time.Duration) {
+	switch policy {
+	case restart.PolicyNo:
+		return false, 0
+	case restart.PolicyUnlessStopped:
+		if manuallyStopped {
+			return false, 0
+		}
+	case restart.PolicyOnFailure:
+		if exitCode == 0 {
+			return false, 0
+		}
+		if maxRetries > 0 && restartCount >= maxRetries {
+			return false, 0
+		}
+	case restart.PolicyAlways:
+		// always restarts, regardless of exit code or manual stop
+	}
+
+	return true, delay(backoff, restartCount)
+}
+
+// decideMissingTask applies the restart policy when a Running-labeled
+// container has no task at all, e.g. right after the monitor starts and
+// finds one whose task was never (re)created. This isn't a real exit --
+// there is no exit code to judge -- so, unlike decide, it must not treat
+// a missing task as PolicyOnFailure's "exited cleanly" case; only an
+// explicit PolicyNo, or an already-exhausted max-retries budget, skips
+// bringing the container back up.
+func decideMissingTask(policy string, restartCount int, maxRetries int, backoff restart.Backoff) (bool, time.Duration) {
+	if policy == restart.PolicyNo {
+		return false, 0
+	}
+	if policy == restart.PolicyOnFailure && maxRetries > 0 && restartCount >= maxRetries {
+		return false, 0
+	}
+	return true, delay(backoff, restartCount)
+}
+
+// delay computes min(max, initial*factor^retries) with symmetric jitter.
+func delay(b restart.Backoff, retries int) time.Duration {
+	d := float64(b.Initial)
+	for i := 0; i < retries; i++ {
+		d *= b.Factor
+	}
+	if max := float64(b.Max); d > max {
+		d = max
+	}
+	if b.Jitter > 0 {
+		spread := d * b.Jitter
+		d += spread*rand.Float64()*2 - spread
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+func (m *monitor) start(ctx context.Context, c restartContainer, labels map[string]string, exitCode uint32, manuallyStopped bool, restartCount int, uptime time.Duration) error {
+	backoff, maxRetries := parseBackoffAndMaxRetries(ctx, c, labels)
+	restartCount = resetRestartCount(restartCount, uptime, backoff)
+
+	should, wait := decide(restart.Policy(labels), exitCode, manuallyStopped, restartCount, maxRetries, backoff)
+	return m.doRestart(ctx, c, labels, should, wait, restartCount, exitCode)
+}
+
+// startMissingTask brings a Running-labeled container back up when it
+// has no task at all. See decideMissingTask for why this can't just
+// call start with a synthesized exitCode.
+func (m *monitor) startMissingTask(ctx context.Context, c restartContainer, labels map[string]string) error {
+	backoff, maxRetries := parseBackoffAndMaxRetries(ctx, c, labels)
+	restartCount, _ := strconv.Atoi(labels[restart.RestartCountLabel])
+
+	should, wait := decideMissingTask(restart.Policy(labels), restartCount, maxRetries, backoff)
+	return m.doRestart(ctx, c, labels, should, wait, restartCount, 0)
+}
+
+func parseBackoffAndMaxRetries(ctx context.Context, c restartContainer, labels map[string]string) (restart.Backoff, int) {
+	backoff, err := restart.ParseBackoff(labels[restart.BackoffLabel])
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("id", c.ID()).Warn("restart monitor: invalid backoff label, using default")
+		backoff = restart.DefaultBackoff
+	}
+	return backoff, restart.MaxRetries(labels)
+}
+
+// doRestart waits out the decided backoff, if any, then creates and
+// starts a new task and persists the outcome onto the container's
+// labels. restartCount and exitCode are the values to persist, already
+// resolved by the caller's decision (start or startMissingTask).
+func (m *monitor) doRestart(ctx context.Context, c restartContainer, labels map[string]string, should bool, wait time.Duration, restartCount int, exitCode uint32) error {
+	if !should {
+		return nil
+	}
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-m.done:
+			return nil
+		}
+	}
+
+	task, err := c.NewTask(ctx, containerd.NullIO)
+	if err != nil {
+		return err
+	}
+	if err := task.Start(ctx); err != nil {
+		return err
+	}
+	m.health.ensure(m, ctx, c.ID(), labels)
+
+	_, err = c.Update(ctx, func(ctx context.Context, client *containerd.Client, c *containers.Container) error {
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		c.Labels[restart.RestartCountLabel] = strconv.Itoa(restartCount + 1)
+		c.Labels[restart.LastExitCodeLabel] = strconv.Itoa(int(exitCode))
+		c.Labels[restart.LastRestartAtLabel] = time.Now().Format(time.RFC3339)
+		return nil
+	})
+	return err
+}
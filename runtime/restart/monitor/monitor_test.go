@@ -0,0 +1,403 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/runtime/restart"
+)
+
+func TestDecidePolicies(t *testing.T) {
+	backoff := restart.DefaultBackoff
+
+	for _, test := range []struct {
+		name            string
+		policy          string
+		exitCode        uint32
+		manuallyStopped bool
+		restartCount    int
+		maxRetries      int
+		wantRestart     bool
+	}{
+		{name: "always restarts on clean exit", policy: restart.PolicyAlways, exitCode: 0, wantRestart: true},
+		{name: "always restarts after manual stop", policy: restart.PolicyAlways, manuallyStopped: true, wantRestart: true},
+		{name: "unless-stopped restarts on crash", policy: restart.PolicyUnlessStopped, exitCode: 1, wantRestart: true},
+		{name: "unless-stopped skips after manual stop", policy: restart.PolicyUnlessStopped, manuallyStopped: true, wantRestart: false},
+		{name: "on-failure skips clean exit", policy: restart.PolicyOnFailure, exitCode: 0, wantRestart: false},
+		{name: "on-failure restarts on crash", policy: restart.PolicyOnFailure, exitCode: 1, wantRestart: true},
+		{name: "on-failure stops after max-retries", policy: restart.PolicyOnFailure, exitCode: 1, restartCount: 3, maxRetries: 3, wantRestart: false},
+		{name: "no never restarts", policy: restart.PolicyNo, exitCode: 1, wantRestart: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, _ := decide(test.policy, test.exitCode, test.manuallyStopped, test.restartCount, test.maxRetries, backoff)
+			if got != test.wantRestart {
+				t.Fatalf("decide() = %v, want %v", got, test.wantRestart)
+			}
+		})
+	}
+}
+
+func TestResetRestartCountAfterUptime(t *testing.T) {
+	backoff := restart.DefaultBackoff
+
+	if got := resetRestartCount(5, backoff.Initial, backoff); got != 5 {
+		t.Fatalf("resetRestartCount() with short uptime = %d, want unchanged 5", got)
+	}
+	if got := resetRestartCount(5, backoff.Initial*11, backoff); got != 0 {
+		t.Fatalf("resetRestartCount() with long uptime = %d, want reset to 0", got)
+	}
+}
+
+func TestDecideRetryCountResetsAfterUptime(t *testing.T) {
+	backoff := restart.DefaultBackoff
+
+	_, shortUptimeDelay := decide(restart.PolicyAlways, 1, false, resetRestartCount(5, backoff.Initial, backoff), 0, backoff)
+	_, longUptimeDelay := decide(restart.PolicyAlways, 1, false, resetRestartCount(5, backoff.Initial*11, backoff), 0, backoff)
+
+	if longUptimeDelay >= shortUptimeDelay {
+		t.Fatalf("expected a long uptime to reset the retry counter and shrink the delay, got short=%v long=%v", shortUptimeDelay, longUptimeDelay)
+	}
+}
+
+// TestDecideOnFailureMaxRetriesResetsAfterUptime proves the bug the
+// reviewer flagged stays fixed: a long healthy uptime must un-exhaust
+// max-retries for PolicyOnFailure, not just shrink the backoff delay.
+// Exercising decide() directly on the raw restartCount (as if the reset
+// had been skipped) must show the opposite, stuck-off behavior, so this
+// test also pins down that resetRestartCount has to run before decide.
+func TestDecideOnFailureMaxRetriesResetsAfterUptime(t *testing.T) {
+	backoff := restart.DefaultBackoff
+	const rawRestartCount = 3
+	const maxRetries = 3
+
+	resetCount := resetRestartCount(rawRestartCount, backoff.Initial*11, backoff)
+	if shouldRestart, _ := decide(restart.PolicyOnFailure, 1, false, resetCount, maxRetries, backoff); !shouldRestart {
+		t.Fatalf("expected a long healthy uptime to un-exhaust max-retries and allow a restart")
+	}
+
+	if shouldRestart, _ := decide(restart.PolicyOnFailure, 1, false, rawRestartCount, maxRetries, backoff); shouldRestart {
+		t.Fatalf("sanity check failed: decide() should still refuse to restart on the raw, un-reset count")
+	}
+}
+
+func TestDelayGrowsExponentiallyAndCapsAtMax(t *testing.T) {
+	backoff := restart.Backoff{Initial: time.Second, Max: 8 * time.Second, Factor: 2, Jitter: 0}
+
+	d0 := delay(backoff, 0)
+	d1 := delay(backoff, 1)
+	d2 := delay(backoff, 2)
+	d10 := delay(backoff, 10)
+
+	if d0 != time.Second {
+		t.Fatalf("delay(0) = %v, want %v", d0, time.Second)
+	}
+	if d1 != 2*time.Second {
+		t.Fatalf("delay(1) = %v, want %v", d1, 2*time.Second)
+	}
+	if d2 != 4*time.Second {
+		t.Fatalf("delay(2) = %v, want %v", d2, 4*time.Second)
+	}
+	if d10 != backoff.Max {
+		t.Fatalf("delay(10) = %v, want capped at %v", d10, backoff.Max)
+	}
+}
+
+// TestDecideMissingTaskDoesNotTreatMissingAsCleanExit proves a missing
+// task doesn't get read as "exited with code 0" -- which would make
+// decide() refuse to restart PolicyOnFailure containers -- while still
+// honoring PolicyNo and an already-exhausted max-retries budget.
+func TestDecideMissingTaskDoesNotTreatMissingAsCleanExit(t *testing.T) {
+	backoff := restart.DefaultBackoff
+
+	for _, test := range []struct {
+		name         string
+		policy       string
+		restartCount int
+		maxRetries   int
+		wantRestart  bool
+	}{
+		{name: "on-failure still restarts despite no exit code", policy: restart.PolicyOnFailure, wantRestart: true},
+		{name: "on-failure still stops after max-retries", policy: restart.PolicyOnFailure, restartCount: 3, maxRetries: 3, wantRestart: false},
+		{name: "always restarts", policy: restart.PolicyAlways, wantRestart: true},
+		{name: "unless-stopped restarts", policy: restart.PolicyUnlessStopped, wantRestart: true},
+		{name: "no never restarts", policy: restart.PolicyNo, wantRestart: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, _ := decideMissingTask(test.policy, test.restartCount, test.maxRetries, backoff)
+			if got != test.wantRestart {
+				t.Fatalf("decideMissingTask() = %v, want %v", got, test.wantRestart)
+			}
+		})
+	}
+
+	// Sanity check pinning down the bug this guards against: decide()
+	// itself, given the same scenario as a synthesized clean exit,
+	// refuses to restart PolicyOnFailure -- which is exactly why the
+	// missing-task path must not go through decide().
+	if shouldRestart, _ := decide(restart.PolicyOnFailure, 0, false, 0, 0, backoff); shouldRestart {
+		t.Fatalf("sanity check failed: decide() with exitCode=0 should refuse to restart PolicyOnFailure")
+	}
+}
+
+// TestReconcileOneMissingTaskRestartsOnFailurePolicy drives the missing
+// task path through reconcileOne end to end, against a PolicyOnFailure
+// container with no task at all -- the scenario decide()'s exit-code
+// gate used to wrongly suppress.
+func TestReconcileOneMissingTaskRestartsOnFailurePolicy(t *testing.T) {
+	backoff := restart.Backoff{Initial: time.Millisecond, Max: time.Millisecond, Factor: 1, Jitter: 0}
+	c := &fakeContainer{
+		id: "never-started",
+		labels: map[string]string{
+			restart.StatusLabel:  string(containerd.Running),
+			restart.PolicyLabel:  restart.PolicyOnFailure,
+			restart.BackoffLabel: backoff.String(),
+		},
+	}
+	m := &monitor{done: make(chan struct{}), health: newHealthMonitors(), restarts: newRestartWorkers()}
+
+	if err := m.reconcileOne(context.Background(), c); err != nil {
+		t.Fatalf("reconcileOne: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.label(restart.RestartCountLabel) != "1" {
+		if time.Now().After(deadline) {
+			t.Fatalf("missing task was never restarted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// BenchmarkReconcileDecision measures the per-container cost of the
+// decision logic the reconciliation sweep (and, per-event, the event
+// path) runs for every tracked container, at a scale of 1k containers
+// comparable to a large host.
+func BenchmarkReconcileDecision(b *testing.B) {
+	const containerCount = 1000
+	backoff := restart.DefaultBackoff
+	policies := []string{restart.PolicyAlways, restart.PolicyUnlessStopped, restart.PolicyOnFailure, restart.PolicyNo}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for n := 0; n < containerCount; n++ {
+			decide(policies[n%len(policies)], uint32(n%2), false, n%5, 3, backoff)
+		}
+	}
+}
+
+// fakeTask is a minimal restartTask: in the sweep's common case (a
+// healthy, already-running container) only Status and Pid are called.
+type fakeTask struct {
+	status containerd.Status
+}
+
+func (f *fakeTask) Pid() uint32                                       { return 1 }
+func (f *fakeTask) Status(context.Context) (containerd.Status, error) { return f.status, nil }
+func (f *fakeTask) Start(context.Context) error                       { return nil }
+func (f *fakeTask) Delete(context.Context) (*containerd.ExitStatus, error) {
+	return nil, nil
+}
+
+// fakeContainer is a minimal restartContainer backed by an in-memory
+// label map and a fake task, with no containerd daemon involved, so
+// reconcileOne can be benchmarked at scale without one. Labels
+// are guarded by a mutex since restartWorkers may still be writing them
+// back (via Update) after reconcileOne/the test has moved on.
+type fakeContainer struct {
+	id   string
+	mu   sync.Mutex
+	task *fakeTask
+
+	labels map[string]string
+}
+
+func (f *fakeContainer) ID() string { return f.id }
+func (f *fakeContainer) Labels(context.Context) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make(map[string]string, len(f.labels))
+	for k, v := range f.labels {
+		out[k] = v
+	}
+	return out, nil
+}
+
+var errFakeTaskNotFound = errors.New("fake: no task")
+
+func (f *fakeContainer) Task(context.Context, cio.Attach) (restartTask, error) {
+	if f.task == nil {
+		return nil, errFakeTaskNotFound
+	}
+	return f.task, nil
+}
+func (f *fakeContainer) NewTask(context.Context, cio.Creator) (restartTask, error) {
+	return f.task, nil
+}
+func (f *fakeContainer) Update(ctx context.Context, opts ...func(context.Context, *containerd.Client, *containers.Container) error) (containerd.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cc := &containers.Container{Labels: f.labels}
+	for _, opt := range opts {
+		if err := opt(ctx, nil, cc); err != nil {
+			return nil, err
+		}
+	}
+	f.labels = cc.Labels
+	return nil, nil
+}
+
+// label reads a single label under the mutex, for tests that poll a
+// fakeContainer's state from outside while a restart may still be in
+// flight on another goroutine.
+func (f *fakeContainer) label(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.labels[key]
+}
+
+// TestHandleExitUsesActualTaskUptimeForRetryReset drives the uptime-based
+// retry-count reset through handleExit (not just resetRestartCount
+// directly), against a labels map shaped the way a real container's
+// would be. It pins down that the reset keys off how long the task
+// actually ran (restart.LastRestartAtLabel to the exit), not off when
+// handleExit happens to be called -- on the event path exitedAt is
+// time.Now() regardless of real uptime, so computing it the old way
+// (time.Since(exitedAt)) meant the reset could basically never fire.
+func TestHandleExitUsesActualTaskUptimeForRetryReset(t *testing.T) {
+	backoff := restart.Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond, Factor: 2, Jitter: 0}
+	exitedAt := time.Now()
+	longAgo := exitedAt.Add(-backoff.Initial * 20).Format(time.RFC3339)
+
+	c := &fakeContainer{
+		id: "long-lived",
+		labels: map[string]string{
+			restart.StatusLabel:        string(containerd.Running),
+			restart.PolicyLabel:        restart.PolicyOnFailure,
+			restart.MaxRetriesLabel:    "3",
+			restart.BackoffLabel:       backoff.String(),
+			restart.RestartCountLabel:  "3",
+			restart.LastRestartAtLabel: longAgo,
+		},
+		task: &fakeTask{status: containerd.Status{Status: containerd.Running}},
+	}
+	m := &monitor{done: make(chan struct{}), health: newHealthMonitors()}
+
+	if err := m.handleExit(context.Background(), c, c.labels, 1, 1, exitedAt); err != nil {
+		t.Fatalf("handleExit: %v", err)
+	}
+
+	if got := c.labels[restart.RestartCountLabel]; got != "1" {
+		t.Fatalf("RestartCountLabel after a long real uptime = %q, want %q (reset then +1)", got, "1")
+	}
+}
+
+// TestReconcileOneDispatchesRestartsAsynchronously proves a container
+// whose restart has a backoff wait doesn't block reconcileOne -- and so
+// doesn't block the reconciliation sweep, or run()'s event loop when
+// dispatched off a task-exit event -- from moving on to the next
+// container. Each restart, backoff wait included, must run on its own
+// goroutine rather than the caller's.
+func TestReconcileOneDispatchesRestartsAsynchronously(t *testing.T) {
+	const containerCount = 20
+	backoff := restart.Backoff{Initial: 100 * time.Millisecond, Max: 100 * time.Millisecond, Factor: 1, Jitter: 0}
+
+	crashed := make([]*fakeContainer, containerCount)
+	asRestartContainers := make([]restartContainer, containerCount)
+	for n := range crashed {
+		c := &fakeContainer{
+			id: fmt.Sprintf("crashed-%d", n),
+			labels: map[string]string{
+				restart.StatusLabel:  string(containerd.Running),
+				restart.PolicyLabel:  restart.PolicyAlways,
+				restart.BackoffLabel: backoff.String(),
+			},
+			task: &fakeTask{status: containerd.Status{Status: containerd.Stopped, ExitStatus: 1, ExitTime: time.Now()}},
+		}
+		crashed[n] = c
+		asRestartContainers[n] = c
+	}
+
+	m := &monitor{done: make(chan struct{}), health: newHealthMonitors(), restarts: newRestartWorkers()}
+	ctx := context.Background()
+
+	start := time.Now()
+	for _, c := range asRestartContainers {
+		if err := m.reconcileOne(ctx, c); err != nil {
+			t.Fatalf("reconcileOne: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= backoff.Initial {
+		t.Fatalf("reconcileOne over %d containers took %v, want well under one backoff wait (%v): restarts are blocking the caller", containerCount, elapsed, backoff.Initial)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		allDone := true
+		for _, c := range crashed {
+			if c.label(restart.RestartCountLabel) != "1" {
+				allDone = false
+			}
+		}
+		if allDone {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("restarts did not complete within the deadline")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// BenchmarkReconcile exercises the real reconcileOne() path
+// — per-container label and task status lookups and the running/not
+// branch — against 1k fake, already-healthy containers, rather than
+// just the cost-free decide() function. Container listing is not
+// exercised; reconcile() itself needs a live client.
+func BenchmarkReconcile(b *testing.B) {
+	const containerCount = 1000
+	containers := make([]restartContainer, containerCount)
+	for n := 0; n < containerCount; n++ {
+		containers[n] = &fakeContainer{
+			id: fmt.Sprintf("container-%d", n),
+			labels: map[string]string{
+				restart.StatusLabel: string(containerd.Running),
+				restart.PolicyLabel: restart.PolicyAlways,
+			},
+			task: &fakeTask{status: containerd.Status{Status: containerd.Running}},
+		}
+	}
+	m := &monitor{health: newHealthMonitors()}
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, c := range containers {
+			if err := m.reconcileOne(ctx, c); err != nil {
+				b.Fatalf("reconcileOne: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package monitor
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+)
+
+// restartWorkers runs each container's restart -- including the backoff
+// wait start() may block on -- on its own goroutine, so a single
+// container's backoff sleep (up to Backoff.Max, 30s by default) can't
+// starve run()'s select loop from dispatching restarts for other
+// containers or from observing new events and reconciliation ticks.
+type restartWorkers struct {
+	mu      sync.Mutex
+	running map[string]struct{}
+}
+
+func newRestartWorkers() *restartWorkers {
+	return &restartWorkers{running: make(map[string]struct{})}
+}
+
+// run starts fn for id in its own goroutine, unless a restart for id is
+// already in flight, in which case this call is dropped: the in-flight
+// one was dispatched from the same labels-driven decision and will
+// reach the same outcome, and the next event or sweep will try again if
+// it doesn't.
+func (r *restartWorkers) run(ctx context.Context, id string, fn func(ctx context.Context) error) {
+	r.mu.Lock()
+	if _, inFlight := r.running[id]; inFlight {
+		r.mu.Unlock()
+		return
+	}
+	r.running[id] = struct{}{}
+	r.mu.Unlock()
+
+	go func() {
+		defer func() {
+			r.mu.Lock()
+			delete(r.running, id)
+			r.mu.Unlock()
+		}()
+		if err := fn(ctx); err != nil {
+			log.G(ctx).WithError(err).WithField("id", id).Error("restart monitor: restart container")
+		}
+	}()
+}
@@ -0,0 +1,91 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package monitor
+
+import (
+	"context"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/containers"
+)
+
+// restartContainer and restartTask are the subset of containerd's
+// Container/Task methods that reconcile/reconcileOne/handleExit/start
+// depend on. Programming against them, instead of the concrete SDK
+// types directly, lets BenchmarkReconcile (and tests) exercise that
+// real code path against a fake container store at scale, rather than
+// only the allocation-free decide() function.
+type restartContainer interface {
+	ID() string
+	Labels(ctx context.Context) (map[string]string, error)
+	Task(ctx context.Context, attach cio.Attach) (restartTask, error)
+	NewTask(ctx context.Context, ioCreate cio.Creator) (restartTask, error)
+	Update(ctx context.Context, opts ...func(context.Context, *containerd.Client, *containers.Container) error) (containerd.Container, error)
+}
+
+type restartTask interface {
+	Pid() uint32
+	Status(ctx context.Context) (containerd.Status, error)
+	Start(ctx context.Context) error
+	Delete(ctx context.Context) (*containerd.ExitStatus, error)
+}
+
+// containerStore is the part of *containerd.Client reconcile() needs to
+// discover containers to sweep.
+type containerStore interface {
+	Containers(ctx context.Context, filters ...string) ([]containerd.Container, error)
+}
+
+// liveContainer adapts a real *containerd.Container into restartContainer.
+// ID, Labels and Update are promoted as-is from the embedded value; Task
+// and NewTask are narrowed to restartTask below, since containerd.Task
+// already satisfies restartTask's (smaller) method set.
+type liveContainer struct {
+	containerd.Container
+}
+
+func (l liveContainer) Task(ctx context.Context, attach cio.Attach) (restartTask, error) {
+	t, err := l.Container.Task(ctx, attach)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (l liveContainer) NewTask(ctx context.Context, ioCreate cio.Creator) (restartTask, error) {
+	t, err := l.Container.NewTask(ctx, ioCreate)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// listRunning lists containers labeled as wanting to run, adapted to
+// restartContainer so reconcile()'s caller doesn't need to know it's
+// talking to the real containerd client.
+func listRunning(ctx context.Context, store containerStore, filter string) ([]restartContainer, error) {
+	cs, err := store.Containers(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]restartContainer, len(cs))
+	for i, c := range cs {
+		out[i] = liveContainer{c}
+	}
+	return out, nil
+}
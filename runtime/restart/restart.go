@@ -0,0 +1,372 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package restart provides function and variables used for
+// "restart monitor" in containerd.
+//
+// The "restart monitor" is a feature to keep the container status
+// reconciled with the desired status (e.g. "running") by monitoring
+// the container status and restarting the container if needed.
+//
+// The actual "restart monitor" logic is implemented as a containerd
+// plugin, in github.com/containerd/containerd/runtime/restart/monitor ,
+// and the plugin is loaded by the `containerd` daemon. So, the
+// "restart monitor" does not work with the containerd client package
+// alone; the daemon has to be configured with the plugin enabled.
+package restart
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+)
+
+const (
+	// StatusLabel sets the restart status label for a container
+	StatusLabel = "containerd.io/restart.status"
+	// PolicyLabel sets the restart policy label for a container, one of
+	// PolicyAlways, PolicyUnlessStopped, PolicyOnFailure, or PolicyNo.
+	PolicyLabel = "containerd.io/restart.policy"
+	// MaxRetriesLabel sets the max restart attempts the monitor should make
+	// before giving up, used together with PolicyOnFailure.
+	MaxRetriesLabel = "containerd.io/restart.max-retries"
+	// BackoffLabel sets the backoff schedule used by the monitor between
+	// restart attempts, encoded as "initial=1s,max=30s,factor=2.0,jitter=0.2".
+	BackoffLabel = "containerd.io/restart.backoff"
+	// CancelNextLabel, when set to the pid of the exited task, tells the
+	// monitor to skip exactly one restart for the container.
+	CancelNextLabel = "containerd.io/restart.cancel-next"
+	// ManuallyStoppedLabel, when set to the pid of the exited task, marks
+	// that the client killed the task on purpose. PolicyUnlessStopped
+	// checks this label to tell a user-initiated stop apart from a crash.
+	ManuallyStoppedLabel = "containerd.io/restart.manually-stopped"
+	// RestartCountLabel records how many times the monitor has restarted
+	// the container since the retry counter was last reset.
+	RestartCountLabel = "containerd.io/restart.count"
+	// LastExitCodeLabel records the exit code observed by the monitor the
+	// last time the task exited.
+	LastExitCodeLabel = "containerd.io/restart.last-exit-code"
+	// LastRestartAtLabel records the time, in RFC 3339 format, at which the
+	// monitor last restarted the container.
+	LastRestartAtLabel = "containerd.io/restart.last-restart-at"
+	// HealthCheckLabel holds the JSON-encoded HealthCheck spec for a
+	// container, if one was configured with WithHealthCheck.
+	HealthCheckLabel = "containerd.io/restart.healthcheck"
+	// HealthStatusLabel records the container's current health state:
+	// one of HealthStarting, HealthHealthy, or HealthUnhealthy.
+	HealthStatusLabel = "containerd.io/restart.health-status"
+	// HealthFailuresLabel records the number of consecutive failed
+	// probes observed since the last successful one.
+	HealthFailuresLabel = "containerd.io/restart.health-failures"
+	// HealthLastOutputLabel records the combined stdout/stderr of the
+	// most recent probe.
+	HealthLastOutputLabel = "containerd.io/restart.health-last-output"
+
+	// HealthStarting is the health state before StartPeriod has elapsed.
+	HealthStarting = "starting"
+	// HealthHealthy is the health state while probes are succeeding.
+	HealthHealthy = "healthy"
+	// HealthUnhealthy is the health state after a failed probe past
+	// StartPeriod; the task is killed once Retries consecutive probes
+	// have failed.
+	HealthUnhealthy = "unhealthy"
+
+	// PolicyAlways always restarts the container regardless of the exit
+	// code, matching Moby's "always" restart policy.
+	PolicyAlways = "always"
+	// PolicyUnlessStopped behaves like PolicyAlways, except that it does not
+	// restart a task that was marked with restart.SetManuallyStopped.
+	PolicyUnlessStopped = "unless-stopped"
+	// PolicyOnFailure only restarts the container if it exited with a
+	// non-zero exit code, and stops trying after MaxRetriesLabel attempts.
+	PolicyOnFailure = "on-failure"
+	// PolicyNo never restarts the container. A container whose
+	// StatusLabel is not Running is not restarted under any policy.
+	PolicyNo = "no"
+
+	// defaultBackoffInitial is used when BackoffLabel is unset.
+	defaultBackoffInitial = time.Second
+	// defaultBackoffMax is used when BackoffLabel is unset.
+	defaultBackoffMax = 30 * time.Second
+	// defaultBackoffFactor is used when BackoffLabel is unset.
+	defaultBackoffFactor = 2.0
+	// defaultBackoffJitter is used when BackoffLabel is unset.
+	defaultBackoffJitter = 0.2
+)
+
+// Backoff describes the exponential backoff schedule the monitor applies
+// between restart attempts of a container, whatever its policy.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Factor  float64
+	Jitter  float64
+}
+
+// DefaultBackoff is used by WithPolicy when no backoff is specified.
+var DefaultBackoff = Backoff{
+	Initial: defaultBackoffInitial,
+	Max:     defaultBackoffMax,
+	Factor:  defaultBackoffFactor,
+	Jitter:  defaultBackoffJitter,
+}
+
+// String encodes the backoff as the value stored under BackoffLabel.
+func (b Backoff) String() string {
+	return fmt.Sprintf("initial=%s,max=%s,factor=%s,jitter=%s",
+		b.Initial, b.Max,
+		strconv.FormatFloat(b.Factor, 'g', -1, 64),
+		strconv.FormatFloat(b.Jitter, 'g', -1, 64))
+}
+
+// ParseBackoff decodes a value previously produced by Backoff.String.
+// Missing fields fall back to DefaultBackoff.
+func ParseBackoff(s string) (Backoff, error) {
+	b := DefaultBackoff
+	if s == "" {
+		return b, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return Backoff{}, fmt.Errorf("invalid backoff field %q", field)
+		}
+		key, value := kv[0], kv[1]
+		var err error
+		switch key {
+		case "initial":
+			b.Initial, err = time.ParseDuration(value)
+		case "max":
+			b.Max, err = time.ParseDuration(value)
+		case "factor":
+			b.Factor, err = strconv.ParseFloat(value, 64)
+		case "jitter":
+			b.Jitter, err = strconv.ParseFloat(value, 64)
+		default:
+			return Backoff{}, fmt.Errorf("unknown backoff field %q", key)
+		}
+		if err != nil {
+			return Backoff{}, fmt.Errorf("invalid backoff field %q: %w", field, err)
+		}
+	}
+	return b, nil
+}
+
+// PolicyOpts configures a restart policy beyond its name, e.g. the max
+// number of retries for PolicyOnFailure or a non-default backoff schedule.
+type PolicyOpts struct {
+	MaxRetries int
+	Backoff    Backoff
+}
+
+// PolicyOption mutates a PolicyOpts.
+type PolicyOption func(*PolicyOpts)
+
+// WithMaxRetries limits the number of restart attempts the monitor will
+// make for a container using PolicyOnFailure. It has no effect with any
+// other policy.
+func WithMaxRetries(max int) PolicyOption {
+	return func(o *PolicyOpts) {
+		o.MaxRetries = max
+	}
+}
+
+// WithBackoff overrides the default exponential backoff schedule used
+// between restart attempts.
+func WithBackoff(b Backoff) PolicyOption {
+	return func(o *PolicyOpts) {
+		o.Backoff = b
+	}
+}
+
+// WithPolicy sets the restart policy used by the monitor for this
+// container. policy must be one of PolicyAlways, PolicyUnlessStopped,
+// PolicyOnFailure, or PolicyNo.
+func WithPolicy(policy string, opts ...PolicyOption) func(context.Context, *containerd.Client, *containers.Container) error {
+	o := PolicyOpts{Backoff: DefaultBackoff}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return func(ctx context.Context, client *containerd.Client, c *containers.Container) error {
+		switch policy {
+		case PolicyAlways, PolicyUnlessStopped, PolicyOnFailure, PolicyNo:
+		default:
+			return fmt.Errorf("invalid restart policy %q", policy)
+		}
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		c.Labels[PolicyLabel] = policy
+		c.Labels[BackoffLabel] = o.Backoff.String()
+		if o.MaxRetries > 0 {
+			c.Labels[MaxRetriesLabel] = strconv.Itoa(o.MaxRetries)
+		}
+		return nil
+	}
+}
+
+// WithStatus sets the status for a container
+func WithStatus(status containerd.ProcessStatus) func(context.Context, *containerd.Client, *containers.Container) error {
+	return func(ctx context.Context, client *containerd.Client, c *containers.Container) error {
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		c.Labels[StatusLabel] = string(status)
+		return nil
+	}
+}
+
+// Status returns the restart status of the container
+func Status(labels map[string]string) string {
+	return labels[StatusLabel]
+}
+
+// Policy returns the restart policy label for the container, defaulting
+// to PolicyAlways for compatibility with containers that predate
+// WithPolicy and only set StatusLabel.
+func Policy(labels map[string]string) string {
+	if p, ok := labels[PolicyLabel]; ok {
+		return p
+	}
+	return PolicyAlways
+}
+
+// MaxRetries returns the configured max-retries for the container, or
+// zero if unset (unlimited).
+func MaxRetries(labels map[string]string) int {
+	n, _ := strconv.Atoi(labels[MaxRetriesLabel])
+	return n
+}
+
+// ExitOnNext marks the container's current task so that the restart
+// monitor skips exactly one restart the next time it exits, then clears
+// the marker. Callers should call ExitOnNext before killing the task,
+// e.g. to implement `docker stop` semantics on top of the restart
+// policies above, without racing the monitor by deleting StatusLabel.
+func ExitOnNext(ctx context.Context, container containerd.Container) error {
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("get task for container %s: %w", container.ID(), err)
+	}
+	pid := task.Pid()
+	_, err = container.Update(ctx, func(_ context.Context, _ *containerd.Client, c *containers.Container) error {
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		c.Labels[CancelNextLabel] = strconv.FormatUint(uint64(pid), 10)
+		return nil
+	})
+	return err
+}
+
+// Cancelled reports whether the monitor should skip a restart for the
+// task that just exited with the given pid, based on a prior call to
+// ExitOnNext.
+func Cancelled(labels map[string]string, pid uint32) bool {
+	v, ok := labels[CancelNextLabel]
+	if !ok {
+		return false
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	return err == nil && uint32(n) == pid
+}
+
+// SetManuallyStopped marks the container's current task as having been
+// stopped on purpose. Callers should call this before killing a task on
+// a container using PolicyUnlessStopped, so the monitor can tell the
+// difference between that and a crash.
+func SetManuallyStopped(ctx context.Context, container containerd.Container) error {
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("get task for container %s: %w", container.ID(), err)
+	}
+	pid := task.Pid()
+	_, err = container.Update(ctx, func(_ context.Context, _ *containerd.Client, c *containers.Container) error {
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		c.Labels[ManuallyStoppedLabel] = strconv.FormatUint(uint64(pid), 10)
+		return nil
+	})
+	return err
+}
+
+// ManuallyStopped reports whether the task that just exited with the
+// given pid was stopped on purpose, per a prior call to
+// SetManuallyStopped.
+func ManuallyStopped(labels map[string]string, pid uint32) bool {
+	v, ok := labels[ManuallyStoppedLabel]
+	if !ok {
+		return false
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	return err == nil && uint32(n) == pid
+}
+
+// HealthCheck describes a probe the monitor runs inside the container
+// on a schedule, mirroring Docker's HEALTHCHECK. StartPeriod gives the
+// container time to come up before failures count against Retries.
+type HealthCheck struct {
+	Cmd         []string
+	Interval    time.Duration
+	Timeout     time.Duration
+	Retries     int
+	StartPeriod time.Duration
+}
+
+// WithHealthCheck configures a health check for the container. When
+// Retries consecutive probes fail after StartPeriod has elapsed, the
+// monitor kills the task, which then restarts according to the
+// container's restart policy.
+func WithHealthCheck(cmd []string, interval, timeout time.Duration, retries int, startPeriod time.Duration) func(context.Context, *containerd.Client, *containers.Container) error {
+	hc := HealthCheck{
+		Cmd:         cmd,
+		Interval:    interval,
+		Timeout:     timeout,
+		Retries:     retries,
+		StartPeriod: startPeriod,
+	}
+	return func(ctx context.Context, client *containerd.Client, c *containers.Container) error {
+		b, err := json.Marshal(hc)
+		if err != nil {
+			return fmt.Errorf("marshal healthcheck: %w", err)
+		}
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		c.Labels[HealthCheckLabel] = string(b)
+		return nil
+	}
+}
+
+// GetHealthCheck returns the container's configured health check, if
+// any. ok is false if the container has no HealthCheckLabel.
+func GetHealthCheck(labels map[string]string) (hc HealthCheck, ok bool, err error) {
+	v, present := labels[HealthCheckLabel]
+	if !present {
+		return HealthCheck{}, false, nil
+	}
+	if err := json.Unmarshal([]byte(v), &hc); err != nil {
+		return HealthCheck{}, true, fmt.Errorf("unmarshal healthcheck: %w", err)
+	}
+	return hc, true, nil
+}
@@ -0,0 +1,143 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package restart
+
+import (
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/containers"
+)
+
+func TestGetHealthCheckRoundTrip(t *testing.T) {
+	c := &containers.Container{}
+	opt := WithHealthCheck([]string{"curl", "-f", "http://localhost/healthz"}, time.Second, 2*time.Second, 3, 5*time.Second)
+	if err := opt(nil, nil, c); err != nil {
+		t.Fatal(err)
+	}
+
+	hc, ok, err := GetHealthCheck(c.Labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected a health check to be present")
+	}
+	if hc.Retries != 3 || hc.Interval != time.Second || hc.Timeout != 2*time.Second || hc.StartPeriod != 5*time.Second {
+		t.Fatalf("unexpected round-tripped health check: %+v", hc)
+	}
+}
+
+func TestGetHealthCheckAbsent(t *testing.T) {
+	_, ok, err := GetHealthCheck(map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected no health check to be present")
+	}
+}
+
+func TestWithPolicyRoundTrip(t *testing.T) {
+	c := &containers.Container{}
+	opt := WithPolicy(PolicyOnFailure, WithMaxRetries(5))
+	if err := opt(nil, nil, c); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := Policy(c.Labels); got != PolicyOnFailure {
+		t.Fatalf("Policy() = %q, want %q", got, PolicyOnFailure)
+	}
+	if got := MaxRetries(c.Labels); got != 5 {
+		t.Fatalf("MaxRetries() = %d, want 5", got)
+	}
+}
+
+func TestPolicyDefaultsToAlways(t *testing.T) {
+	if got := Policy(map[string]string{}); got != PolicyAlways {
+		t.Fatalf("Policy() on unset label = %q, want %q", got, PolicyAlways)
+	}
+}
+
+func TestMaxRetriesDefaultsToZero(t *testing.T) {
+	if got := MaxRetries(map[string]string{}); got != 0 {
+		t.Fatalf("MaxRetries() on unset label = %d, want 0", got)
+	}
+}
+
+func TestWithPolicyRejectsUnknownPolicy(t *testing.T) {
+	c := &containers.Container{}
+	opt := WithPolicy("bogus")
+	if err := opt(nil, nil, c); err == nil {
+		t.Fatal("expected an error for an unknown restart policy")
+	}
+}
+
+func TestBackoffStringParseRoundTrip(t *testing.T) {
+	b := Backoff{Initial: 2 * time.Second, Max: time.Minute, Factor: 1.5, Jitter: 0.1}
+
+	got, err := ParseBackoff(b.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != b {
+		t.Fatalf("ParseBackoff(%q) = %+v, want %+v", b.String(), got, b)
+	}
+}
+
+func TestParseBackoffEmptyIsDefault(t *testing.T) {
+	got, err := ParseBackoff("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != DefaultBackoff {
+		t.Fatalf("ParseBackoff(\"\") = %+v, want %+v", got, DefaultBackoff)
+	}
+}
+
+func TestParseBackoffErrors(t *testing.T) {
+	for _, s := range []string{
+		"initial",
+		"initial=notaduration",
+		"factor=notafloat",
+		"bogus=1s",
+	} {
+		if _, err := ParseBackoff(s); err == nil {
+			t.Fatalf("ParseBackoff(%q): expected an error", s)
+		}
+	}
+}
+
+// TestCancelledRoundTrip exercises the label contract ExitOnNext and
+// Cancelled share. ExitOnNext itself needs a live containerd.Container
+// (to look up the running task's pid); the integration suite's
+// TestRestartMonitorExitOnNext sets the same label through its own copy
+// of it, setCancelNext. Here we pin down Cancelled's
+// half directly, against labels shaped the way ExitOnNext produces them.
+func TestCancelledRoundTrip(t *testing.T) {
+	labels := map[string]string{CancelNextLabel: "4242"}
+
+	if !Cancelled(labels, 4242) {
+		t.Fatal("expected Cancelled to match the pid set by ExitOnNext")
+	}
+	if Cancelled(labels, 1) {
+		t.Fatal("expected Cancelled to reject a different pid")
+	}
+	if Cancelled(map[string]string{}, 4242) {
+		t.Fatal("expected Cancelled to be false with no CancelNextLabel set")
+	}
+}